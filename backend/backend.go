@@ -0,0 +1,58 @@
+// Package backend defines the interface each supported CI system
+// implements, so that the HTTP layer can resolve "the latest successful
+// build of X [matching tag]" and serve one of its artifacts without
+// knowing which CI system is actually backing a given mount.
+package backend
+
+import "io"
+
+// Backend abstracts over a CI system's REST API. What exactly a
+// "buildTypeID", "tag", and "build id" mean is backend-specific: for
+// TeamCity they're a build configuration id, a VCS tag, and a numeric
+// build id; for GitLab CI, for example, buildTypeID and tag are more
+// naturally a project id and a ref.
+type Backend interface {
+	// BuildTypeIDSegments reports how many leading "/"-delimited
+	// segments of a request path make up buildTypeID, so the HTTP layer
+	// can split "/buildTypeID/[tag]/artifactName" correctly even when
+	// buildTypeID itself contains a literal "/", as it does for Drone
+	// and GitHub Actions' "owner/name" convention. Most backends return
+	// 1.
+	BuildTypeIDSegments() int
+
+	// LatestBuildID resolves buildTypeID (and, if set, tag) to an
+	// opaque identifier to pass to the other methods.
+	LatestBuildID(buildTypeID, tag string) (string, error)
+
+	// ArtifactHash returns a content hash for artifactName at buildID,
+	// for use as an ETag, if the backend can provide one cheaply. An
+	// empty string with a nil error means the backend has no such
+	// concept and callers shouldn't expect If-None-Match to short
+	// circuit.
+	ArtifactHash(buildID, artifactName string) (string, error)
+
+	// ArtifactSize returns the size, in bytes, of artifactName at
+	// buildID, without downloading its body.
+	ArtifactSize(buildID, artifactName string) (int64, error)
+
+	// Download returns artifactName's body at buildID. If rangeHeader is
+	// non-empty, it's the client's original "Range: bytes=..." header
+	// value; backends that proxy a plain upstream GET should forward it
+	// as-is and report back whatever status/Content-Range the upstream
+	// responded with. Returning StatusCode 200 (with the whole body,
+	// ignoring rangeHeader) is always a valid fallback: callers must
+	// handle both.
+	Download(buildID, artifactName, rangeHeader string) (DownloadResult, error)
+}
+
+// DownloadResult is the result of a Backend.Download call. Body must be
+// closed by the caller.
+type DownloadResult struct {
+	Body       io.ReadCloser
+	Size       int64 // Content-Length of this response, whether partial or whole
+	StatusCode int   // 200 (whole body) or 206 (honored rangeHeader, below)
+
+	// ContentRange is the upstream's Content-Range header value, set
+	// only when StatusCode is 206.
+	ContentRange string
+}
@@ -0,0 +1,191 @@
+// Package drone implements backend.Backend against a Drone/Woodpecker
+// server.
+//
+// Drone core has no standardized artifact storage api the way TeamCity
+// does; "artifacts" are usually whatever a build step happens to push
+// somewhere. This backend assumes the common convention of an
+// artifact-publishing step making files available under
+// /api/repos/:owner/:name/builds/:number/artifacts/:artifactName, which
+// is true of setups using the drone-cache or artifact plugins with their
+// default configuration. buildTypeID is "owner/name".
+package drone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/levenlabs/teamcity-latest/backend"
+)
+
+// Backend talks to a single Drone/Woodpecker server.
+type Backend struct {
+	Addr  string
+	Token string // sent as a Bearer token
+}
+
+// New returns a Backend for the Drone/Woodpecker server at addr,
+// authenticating with a personal access token.
+func New(addr, token string) *Backend {
+	return &Backend{Addr: addr, Token: token}
+}
+
+// BuildTypeIDSegments implements backend.Backend. buildTypeID here is
+// "owner/name", two path segments.
+func (b *Backend) BuildTypeIDSegments() int { return 2 }
+
+func (b *Backend) do(method, u, rangeHeader string) (*http.Response, error) {
+	r, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	return http.DefaultClient.Do(r)
+}
+
+// LatestBuildID implements backend.Backend. tag is unused: Drone's
+// "latest build" route already returns the latest build regardless of
+// branch/tag. The build's status isn't checked either, so the build
+// resolved to may be one that failed or is still running.
+func (b *Backend) LatestBuildID(repo, tag string) (string, error) {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	u := fmt.Sprintf("%s/api/repos/%s/%s/builds/latest", b.Addr, owner, name)
+	resp, err := b.do("GET", u, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("drone returned %s: %s", resp.Status, body)
+	}
+
+	out := struct {
+		Number int `json:"number"`
+	}{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", errors.New(string(body))
+	}
+
+	return repo + "|" + strconv.Itoa(out.Number), nil
+}
+
+// ArtifactHash implements backend.Backend. Drone has no content-hash
+// lookup, so this always returns "".
+func (b *Backend) ArtifactHash(buildID, artifactName string) (string, error) {
+	return "", nil
+}
+
+// ArtifactSize implements backend.Backend.
+func (b *Backend) ArtifactSize(buildID, artifactName string) (int64, error) {
+	u, err := b.artifactURL(buildID, artifactName)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.do("HEAD", u, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("drone didn't report a size for %s", artifactName)
+	}
+	return resp.ContentLength, nil
+}
+
+// Download implements backend.Backend. It forwards rangeHeader to the
+// artifact's plugin-served URL as-is; whether that's honored depends on
+// the artifact plugin in use, which is why StatusCode always needs
+// checking rather than assuming rangeHeader was respected.
+func (b *Backend) Download(buildID, artifactName, rangeHeader string) (backend.DownloadResult, error) {
+	u, err := b.artifactURL(buildID, artifactName)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+	resp, err := b.do("GET", u, rangeHeader)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+
+	if resp.StatusCode >= 300 {
+		berr, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return backend.DownloadResult{}, err
+		}
+		return backend.DownloadResult{}, errors.New(string(berr))
+	}
+
+	return backend.DownloadResult{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		StatusCode:   resp.StatusCode,
+		ContentRange: resp.Header.Get("Content-Range"),
+	}, nil
+}
+
+func (b *Backend) artifactURL(buildID, artifactName string) (string, error) {
+	repo, number, err := splitBuildID(buildID)
+	if err != nil {
+		return "", err
+	}
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"%s/api/repos/%s/%s/builds/%s/artifacts/%s",
+		b.Addr,
+		url.PathEscape(owner),
+		url.PathEscape(name),
+		url.PathEscape(number),
+		escapePathSegments(artifactName),
+	), nil
+}
+
+// escapePathSegments percent-escapes each "/"-delimited segment of s,
+// without escaping the "/" itself, since an artifact-publishing step can
+// put artifactName under a subdirectory and that needs to stay a
+// multi-segment path in the upstream URL.
+func escapePathSegments(s string) string {
+	segs := strings.Split(s, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func splitRepo(repo string) (owner, name string, err error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("drone buildTypeID must be 'owner/name'")
+	}
+	return parts[0], parts[1], nil
+}
+
+func splitBuildID(buildID string) (repo, number string, err error) {
+	parts := strings.SplitN(buildID, "|", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed drone build id")
+	}
+	return parts[0], parts[1], nil
+}
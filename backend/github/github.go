@@ -0,0 +1,229 @@
+// Package github implements backend.Backend against the GitHub Actions
+// artifacts api.
+//
+// GitHub always packages an artifact as a zip, and its api has no
+// concept of "path inside the artifact", so artifactName here is the
+// artifact's own name (as set by actions/upload-artifact) and Download
+// returns the whole zip. buildTypeID is "owner/repo"; tag, if given, is
+// the branch to restrict the search to.
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/levenlabs/teamcity-latest/backend"
+)
+
+// Backend talks to the GitHub (or GitHub Enterprise) Actions api.
+type Backend struct {
+	Addr  string // e.g. "https://api.github.com"
+	Token string // sent as a Bearer token
+}
+
+// New returns a Backend for the GitHub REST api at addr, authenticating
+// with a personal access token.
+func New(addr, token string) *Backend {
+	return &Backend{Addr: addr, Token: token}
+}
+
+// BuildTypeIDSegments implements backend.Backend. buildTypeID here is
+// "owner/repo", two path segments.
+func (b *Backend) BuildTypeIDSegments() int { return 2 }
+
+// client strips the Authorization header on any redirect to a different
+// host, since GitHub's artifact download redirects to a pre-signed
+// Azure/S3 URL that rejects requests carrying our GitHub token.
+var client = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) == 0 {
+			return nil
+		}
+		if req.URL.Host != via[0].URL.Host {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	},
+}
+
+func (b *Backend) do(method, u, rangeHeader string) (*http.Response, error) {
+	r, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Accept", "application/vnd.github+json")
+	if b.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	return client.Do(r)
+}
+
+// LatestBuildID implements backend.Backend. If tag is set it's resolved
+// to the most recent successful workflow run on that branch; otherwise
+// artifact lookups fall back to searching the repo's full artifact list
+// by name.
+func (b *Backend) LatestBuildID(repo, tag string) (string, error) {
+	owner, name, err := splitRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	if tag == "" {
+		return owner + "|" + name + "|", nil
+	}
+
+	u := fmt.Sprintf(
+		"%s/repos/%s/%s/actions/runs?branch=%s&status=success&per_page=1",
+		b.Addr, owner, name, url.QueryEscape(tag),
+	)
+	resp, err := b.do("GET", u, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("github returned %s: %s", resp.Status, body)
+	}
+
+	out := struct {
+		WorkflowRuns []struct {
+			ID int64 `json:"id"`
+		} `json:"workflow_runs"`
+	}{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", errors.New(string(body))
+	}
+	if len(out.WorkflowRuns) < 1 {
+		return "", fmt.Errorf("no successful runs on branch '%s' found", tag)
+	}
+
+	return owner + "|" + name + "|" + strconv.FormatInt(out.WorkflowRuns[0].ID, 10), nil
+}
+
+// ArtifactHash implements backend.Backend. The Actions api doesn't
+// expose a content hash, so this always returns "".
+func (b *Backend) ArtifactHash(buildID, artifactName string) (string, error) {
+	return "", nil
+}
+
+// ArtifactSize implements backend.Backend.
+func (b *Backend) ArtifactSize(buildID, artifactName string) (int64, error) {
+	a, err := b.findArtifact(buildID, artifactName)
+	if err != nil {
+		return 0, err
+	}
+	return a.SizeInBytes, nil
+}
+
+// Download implements backend.Backend. It forwards rangeHeader on the
+// archive download request, which GitHub redirects to a pre-signed
+// Azure/S3 blob URL (not the GitHub api itself); the header is carried
+// across that redirect, and those blob URLs commonly honor Range, but since that's outside GitHub's documented api contract, the
+// caller must still check StatusCode rather than assume 206.
+func (b *Backend) Download(buildID, artifactName, rangeHeader string) (backend.DownloadResult, error) {
+	a, err := b.findArtifact(buildID, artifactName)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+
+	resp, err := b.do("GET", a.ArchiveDownloadURL, rangeHeader)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+	if resp.StatusCode >= 300 {
+		berr, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return backend.DownloadResult{}, fmt.Errorf("github returned %s: %s", resp.Status, berr)
+	}
+
+	return backend.DownloadResult{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		StatusCode:   resp.StatusCode,
+		ContentRange: resp.Header.Get("Content-Range"),
+	}, nil
+}
+
+type artifact struct {
+	Name               string `json:"name"`
+	SizeInBytes        int64  `json:"size_in_bytes"`
+	Expired            bool   `json:"expired"`
+	ArchiveDownloadURL string `json:"archive_download_url"`
+}
+
+// findArtifact resolves artifactName to a non-expired artifact, either
+// within a specific run (if LatestBuildID resolved one) or by searching
+// the repo's artifact list, which GitHub returns newest-first. Only the
+// first page of 100 artifacts is searched, so an older artifact isn't
+// found. The repo-wide search doesn't check whether the run that
+// produced the artifact succeeded.
+func (b *Backend) findArtifact(buildID, artifactName string) (artifact, error) {
+	owner, name, runID, err := splitBuildID(buildID)
+	if err != nil {
+		return artifact{}, err
+	}
+
+	var u string
+	if runID != "" {
+		u = fmt.Sprintf("%s/repos/%s/%s/actions/runs/%s/artifacts?per_page=100", b.Addr, owner, name, runID)
+	} else {
+		u = fmt.Sprintf("%s/repos/%s/%s/actions/artifacts?per_page=100", b.Addr, owner, name)
+	}
+
+	resp, err := b.do("GET", u, "")
+	if err != nil {
+		return artifact{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return artifact{}, err
+	}
+	if resp.StatusCode >= 300 {
+		return artifact{}, fmt.Errorf("github returned %s: %s", resp.Status, body)
+	}
+
+	out := struct {
+		Artifacts []artifact `json:"artifacts"`
+	}{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return artifact{}, errors.New(string(body))
+	}
+
+	for _, a := range out.Artifacts {
+		if a.Name == artifactName && !a.Expired {
+			return a, nil
+		}
+	}
+	return artifact{}, fmt.Errorf("no unexpired artifact named '%s' found", artifactName)
+}
+
+func splitRepo(repo string) (owner, name string, err error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("github buildTypeID must be 'owner/repo'")
+	}
+	return parts[0], parts[1], nil
+}
+
+func splitBuildID(buildID string) (owner, name, runID string, err error) {
+	parts := strings.SplitN(buildID, "|", 3)
+	if len(parts) != 3 {
+		return "", "", "", errors.New("malformed github build id")
+	}
+	return parts[0], parts[1], parts[2], nil
+}
@@ -0,0 +1,168 @@
+// Package gitlab implements backend.Backend against the GitLab CI
+// artifacts api.
+//
+// GitLab has no separate "resolve the latest build id" step: its
+// artifact download route already resolves to the latest successful
+// job for a ref. So buildTypeID here is a GitLab project id and tag is
+// a git ref (branch or tag name); LatestBuildID packs both of those into
+// the opaque build id it returns, since they're both needed later to
+// build the download URL. artifactName is "job/path/to/file", since a
+// single ref can have artifacts from several jobs.
+package gitlab
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/levenlabs/teamcity-latest/backend"
+)
+
+// Backend talks to a single GitLab instance's artifacts api.
+type Backend struct {
+	Addr  string // e.g. "https://gitlab.com"
+	Token string // sent as PRIVATE-TOKEN
+}
+
+// New returns a Backend for the GitLab instance at addr, authenticating
+// with a personal/project access token.
+func New(addr, token string) *Backend {
+	return &Backend{Addr: addr, Token: token}
+}
+
+// BuildTypeIDSegments implements backend.Backend. A GitLab project id is
+// a single path segment.
+func (b *Backend) BuildTypeIDSegments() int { return 1 }
+
+func (b *Backend) do(method, u, rangeHeader string) (*http.Response, error) {
+	r, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Token != "" {
+		r.Header.Set("PRIVATE-TOKEN", b.Token)
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	return http.DefaultClient.Do(r)
+}
+
+// LatestBuildID implements backend.Backend. GitLab resolves "latest" as
+// part of the download route itself, so there's nothing to look up
+// ahead of time; projectID and ref are just packed together for later
+// calls.
+func (b *Backend) LatestBuildID(projectID, ref string) (string, error) {
+	if ref == "" {
+		return "", errors.New("gitlab backend requires a ref (tag) to be specified")
+	}
+	if projectID == "" {
+		return "", errors.New("gitlab backend requires a project id (buildTypeID)")
+	}
+	return projectID + "|" + ref, nil
+}
+
+// ArtifactHash implements backend.Backend. GitLab's artifacts api has no
+// equivalent of a cheap content-hash lookup, so this always returns "".
+func (b *Backend) ArtifactHash(buildID, artifactName string) (string, error) {
+	return "", nil
+}
+
+// ArtifactSize implements backend.Backend.
+func (b *Backend) ArtifactSize(buildID, artifactName string) (int64, error) {
+	u, err := b.artifactURL(buildID, artifactName)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.do("HEAD", u, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("gitlab didn't report a size for %s", artifactName)
+	}
+	return resp.ContentLength, nil
+}
+
+// Download implements backend.Backend. It forwards rangeHeader to
+// GitLab as-is, which honors Range on its raw artifact file route, so a
+// resumed download only re-fetches the bytes it's missing.
+func (b *Backend) Download(buildID, artifactName, rangeHeader string) (backend.DownloadResult, error) {
+	u, err := b.artifactURL(buildID, artifactName)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+	resp, err := b.do("GET", u, rangeHeader)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+
+	if resp.StatusCode >= 300 {
+		berr, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return backend.DownloadResult{}, fmt.Errorf("gitlab returned %s: %s", resp.Status, berr)
+	}
+
+	return backend.DownloadResult{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		StatusCode:   resp.StatusCode,
+		ContentRange: resp.Header.Get("Content-Range"),
+	}, nil
+}
+
+// artifactURL builds the GitLab "download a single artifact file" route:
+// /api/v4/projects/:id/jobs/artifacts/:ref/raw/*path?job=
+func (b *Backend) artifactURL(buildID, artifactName string) (string, error) {
+	projectID, ref, err := splitBuildID(buildID)
+	if err != nil {
+		return "", err
+	}
+	job, path, err := splitArtifactName(artifactName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"%s/api/v4/projects/%s/jobs/artifacts/%s/raw/%s?job=%s",
+		b.Addr,
+		url.PathEscape(projectID),
+		url.PathEscape(ref),
+		escapePathSegments(path),
+		url.QueryEscape(job),
+	), nil
+}
+
+// escapePathSegments percent-escapes each "/"-delimited segment of s,
+// without escaping the "/" itself, since path is "path/to/file" and
+// needs to stay a multi-segment path in the upstream URL.
+func escapePathSegments(s string) string {
+	segs := strings.Split(s, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func splitBuildID(buildID string) (projectID, ref string, err error) {
+	parts := strings.SplitN(buildID, "|", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed gitlab build id")
+	}
+	return parts[0], parts[1], nil
+}
+
+// splitArtifactName pulls the job name and artifact path out of the
+// generic artifactName the HTTP layer gives every backend, which for
+// this backend is "job/path/to/file".
+func splitArtifactName(artifactName string) (job, path string, err error) {
+	parts := strings.SplitN(artifactName, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("gitlab artifact name must be 'job/path/to/file'")
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,166 @@
+// Package teamcity implements backend.Backend against the TeamCity REST
+// api. This is the original, and default, backend teamcity-latest was
+// built around.
+package teamcity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/levenlabs/teamcity-latest/backend"
+)
+
+// Backend talks to a single TeamCity server's REST api.
+type Backend struct {
+	Addr string
+	User string
+	Pass string
+}
+
+// New returns a Backend for the TeamCity REST api at addr, authenticating
+// as user/pass.
+func New(addr, user, pass string) *Backend {
+	return &Backend{Addr: addr, User: user, Pass: pass}
+}
+
+// BuildTypeIDSegments implements backend.Backend. A TeamCity build
+// configuration id is a single path segment.
+func (b *Backend) BuildTypeIDSegments() int { return 1 }
+
+func (b *Backend) do(method, url, rangeHeader string) (*http.Response, error) {
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.SetBasicAuth(b.User, b.Pass)
+	if method == "GET" {
+		r.Header.Set("Accept", "application/json")
+	}
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	return http.DefaultClient.Do(r)
+}
+
+// LatestBuildID implements backend.Backend.
+func (b *Backend) LatestBuildID(buildTypeID, tag string) (string, error) {
+	//status:SUCCESS means it succeeded
+	//branch:default:any means it can come from any branch
+	//count:1 means return the latest match only
+	l := []string{"status:SUCCESS", "branch:default:any", "count:1"}
+	//buildType:id:{id} will only return builds for the buildTypeID
+	l = append(l, fmt.Sprintf("buildType:id:%s", buildTypeID))
+	//if a tag was sent then filter to builds including this tag(s)
+	if tag != "" {
+		l = append(l, fmt.Sprintf("tag:%s", tag))
+	}
+	u := fmt.Sprintf(
+		"%s/httpAuth/app/rest/builds/?locator=%s",
+		b.Addr,
+		strings.Join(l, ","),
+	)
+
+	resp, err := b.do("GET", u, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	out := struct {
+		Builds []struct {
+			ID int `json:"id"`
+		} `json:"build"`
+	}{}
+
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", errors.New(string(body))
+	}
+
+	if len(out.Builds) < 1 {
+		return "", fmt.Errorf("no builds with tag '%s' found", tag)
+	}
+
+	return strconv.Itoa(out.Builds[0].ID), nil
+}
+
+// ArtifactHash implements backend.Backend.
+func (b *Backend) ArtifactHash(id, artifactName string) (string, error) {
+	u := fmt.Sprintf(
+		"%s/httpAuth/app/rest/builds/id:%s/artifacts/content/%s.md5",
+		b.Addr,
+		id,
+		artifactName,
+	)
+
+	resp, err := b.do("GET", u, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	berr, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(berr)), nil
+}
+
+// ArtifactSize implements backend.Backend.
+func (b *Backend) ArtifactSize(id, artifactName string) (int64, error) {
+	resp, err := b.do("HEAD", b.artifactURL(id, artifactName), "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("teamcity didn't report a size for %s", artifactName)
+	}
+	return resp.ContentLength, nil
+}
+
+// Download implements backend.Backend. It forwards rangeHeader to
+// TeamCity as-is, which honors Range on artifact downloads, so a
+// resumed download only re-fetches the bytes it's missing.
+func (b *Backend) Download(id, artifactName, rangeHeader string) (backend.DownloadResult, error) {
+	resp, err := b.do("GET", b.artifactURL(id, artifactName), rangeHeader)
+	if err != nil {
+		return backend.DownloadResult{}, err
+	}
+
+	if resp.StatusCode >= 300 {
+		berr, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return backend.DownloadResult{}, err
+		}
+		return backend.DownloadResult{}, errors.New(string(berr))
+	}
+
+	return backend.DownloadResult{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		StatusCode:   resp.StatusCode,
+		ContentRange: resp.Header.Get("Content-Range"),
+	}, nil
+}
+
+func (b *Backend) artifactURL(id, artifactName string) string {
+	return fmt.Sprintf(
+		"%s/httpAuth/app/rest/builds/id:%s/artifacts/content/%s",
+		b.Addr,
+		id,
+		artifactName,
+	)
+}
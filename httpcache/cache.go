@@ -0,0 +1,30 @@
+// Package httpcache provides a small caching layer for the upstream
+// TeamCity REST responses and artifact bodies, so that repeated requests
+// for the same build don't all have to round-trip to TeamCity.
+package httpcache
+
+import "time"
+
+// Entry is a single cached value. ETag is optional and, when set, lets
+// callers short-circuit an upstream request with an If-None-Match check
+// before ever touching Body.
+type Entry struct {
+	ETag     string
+	Body     []byte
+	StoredAt time.Time
+}
+
+// Fresh reports whether e is still within its TTL as of now.
+func (e Entry) Fresh(ttl time.Duration, now time.Time) bool {
+	return now.Sub(e.StoredAt) < ttl
+}
+
+// Cache is the interface implemented by the cache backends in this
+// package. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the entry stored under key, if any.
+	Get(key string) (Entry, bool)
+	// Set stores e under key, evicting older entries if the cache is
+	// over its configured size budget.
+	Set(key string, e Entry)
+}
@@ -0,0 +1,213 @@
+package httpcache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metaSuffix names the sidecar file Disk writes next to each body file,
+// recording the metadata (key, ETag, StoredAt, size) needed to rebuild
+// index/sizes/order on the next NewDisk, since the body file's name is
+// just a hash of the key and can't be reversed back into it.
+const metaSuffix = ".meta"
+
+// Disk is a Cache which keeps entry metadata (ETag, size, timestamp) in
+// memory but spills bodies to files under dir, so that a restart of the
+// process doesn't lose large cached artifacts and memory use stays
+// bounded regardless of artifact size. NewDisk reconciles index/sizes/
+// order against dir's contents, so a restart resumes with a warm cache
+// instead of starting fully cold, and files left behind by a previous
+// process (e.g. after a crash mid-write) don't accumulate forever.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	index map[string]Entry // entry.Body is never populated here
+	sizes map[string]int64 // size of the file on disk for key
+	order []string         // least-recently-used first
+	bytes int64
+}
+
+// diskMeta is the sidecar JSON written alongside each body file.
+type diskMeta struct {
+	Key      string
+	ETag     string
+	StoredAt time.Time
+	Size     int64
+}
+
+// NewDisk returns a Disk cache rooted at dir, which is created if it
+// doesn't already exist. maxBytes bounds the total size of files kept on
+// disk; 0 means unbounded. Any entries left on disk by a previous
+// process are reloaded via reconcile.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    map[string]Entry{},
+		sizes:    map[string]int64{},
+	}
+	if err := d.reconcile(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Disk) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *Disk) metaPath(key string) string {
+	return d.path(key) + metaSuffix
+}
+
+// reconcile scans dir for sidecar files written by a previous process
+// and rebuilds index/sizes/order from them, restoring entries oldest-
+// first by StoredAt (a reasonable approximation of LRU order, since
+// actual access order isn't persisted). Body files with no valid
+// sidecar, and sidecars with no body, are removed rather than left to
+// accumulate as an untracked disk leak.
+func (d *Disk) reconcile() error {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	var metas []diskMeta
+	for _, de := range dirEntries {
+		if !strings.HasSuffix(de.Name(), metaSuffix) {
+			continue
+		}
+		mb, err := os.ReadFile(filepath.Join(d.dir, de.Name()))
+		if err != nil {
+			continue
+		}
+		var meta diskMeta
+		if err := json.Unmarshal(mb, &meta); err != nil {
+			os.Remove(filepath.Join(d.dir, de.Name()))
+			continue
+		}
+		if _, err := os.Stat(d.path(meta.Key)); err != nil {
+			os.Remove(filepath.Join(d.dir, de.Name()))
+			continue
+		}
+		metas = append(metas, meta)
+	}
+
+	sort.Slice(metas, func(i, j int) bool { return metas[i].StoredAt.Before(metas[j].StoredAt) })
+
+	known := map[string]bool{}
+	for _, meta := range metas {
+		d.index[meta.Key] = Entry{ETag: meta.ETag, StoredAt: meta.StoredAt}
+		d.sizes[meta.Key] = meta.Size
+		d.order = append(d.order, meta.Key)
+		d.bytes += meta.Size
+		known[filepath.Base(d.path(meta.Key))] = true
+	}
+
+	for _, de := range dirEntries {
+		base := strings.TrimSuffix(de.Name(), metaSuffix)
+		if !known[base] {
+			os.Remove(filepath.Join(d.dir, de.Name()))
+		}
+	}
+
+	d.evict()
+	return nil
+}
+
+// Get implements Cache.
+func (d *Disk) Get(key string) (Entry, bool) {
+	d.mu.Lock()
+	meta, ok := d.index[key]
+	if ok {
+		d.touch(key)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return Entry{}, false
+	}
+
+	body, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return Entry{}, false
+	}
+	meta.Body = body
+	return meta, true
+}
+
+// Set implements Cache.
+func (d *Disk) Set(key string, e Entry) {
+	bp := d.path(key)
+	if err := os.WriteFile(bp, e.Body, 0644); err != nil {
+		return
+	}
+	size := int64(len(e.Body))
+
+	meta := e
+	meta.Body = nil
+
+	mb, err := json.Marshal(diskMeta{Key: key, ETag: e.ETag, StoredAt: e.StoredAt, Size: size})
+	if err != nil {
+		os.Remove(bp)
+		return
+	}
+	if err := os.WriteFile(d.metaPath(key), mb, 0644); err != nil {
+		os.Remove(bp)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.index[key]; ok {
+		d.bytes -= d.sizes[key]
+	} else {
+		d.order = append(d.order, key)
+	}
+	d.index[key] = meta
+	d.sizes[key] = size
+	d.bytes += size
+	d.touch(key)
+	d.evict()
+}
+
+// touch must be called with d.mu held; it moves key to the back of order
+// (most-recently-used).
+func (d *Disk) touch(key string) {
+	for i, k := range d.order {
+		if k == key {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+	d.order = append(d.order, key)
+}
+
+// evict must be called with d.mu held.
+func (d *Disk) evict() {
+	if d.maxBytes <= 0 {
+		return
+	}
+	for d.bytes > d.maxBytes && len(d.order) > 0 {
+		oldest := d.order[0]
+		d.order = d.order[1:]
+		delete(d.index, oldest)
+		d.bytes -= d.sizes[oldest]
+		delete(d.sizes, oldest)
+		os.Remove(d.path(oldest))
+		os.Remove(d.metaPath(oldest))
+	}
+}
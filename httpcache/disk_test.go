@@ -0,0 +1,102 @@
+package httpcache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskGetSet(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Set("a", Entry{ETag: "etag-a", Body: []byte("hello")})
+
+	e, ok := d.Get("a")
+	if !ok {
+		t.Fatal("expected a hit for a freshly set key")
+	}
+	if string(e.Body) != "hello" || e.ETag != "etag-a" {
+		t.Errorf("got %+v, want body %q etag %q", e, "hello", "etag-a")
+	}
+
+	if _, ok := d.Get("b"); ok {
+		t.Error("expected a miss for a key that was never set")
+	}
+}
+
+func TestDiskEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Set("a", Entry{Body: []byte("1")})
+	d.Set("b", Entry{Body: []byte("1")})
+
+	if _, ok := d.Get("a"); !ok {
+		t.Fatal("expected a hit for a")
+	}
+
+	d.Set("c", Entry{Body: []byte("1")})
+
+	if _, ok := d.Get("b"); ok {
+		t.Error("expected b to have been evicted as the least recently used")
+	}
+	if _, ok := d.Get("a"); !ok {
+		t.Error("expected a to survive eviction since it was touched last")
+	}
+
+	// evicted entries' files shouldn't be left behind on disk
+	if _, err := os.Stat(d.path("b")); !os.IsNotExist(err) {
+		t.Error("expected b's body file to have been removed on eviction")
+	}
+	if _, err := os.Stat(d.metaPath("b")); !os.IsNotExist(err) {
+		t.Error("expected b's sidecar file to have been removed on eviction")
+	}
+}
+
+func TestDiskSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	d1, err := NewDisk(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1.Set("a", Entry{ETag: "etag-a", Body: []byte("hello"), StoredAt: time.Now()})
+
+	d2, err := NewDisk(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := d2.Get("a")
+	if !ok {
+		t.Fatal("expected a second Disk rooted at the same dir to pick up the first's entries")
+	}
+	if string(e.Body) != "hello" || e.ETag != "etag-a" {
+		t.Errorf("got %+v, want body %q etag %q", e, "hello", "etag-a")
+	}
+}
+
+func TestDiskReconcileDropsOrphans(t *testing.T) {
+	dir := t.TempDir()
+
+	// a body file with no sidecar, left behind e.g. by a crash mid-write
+	if err := os.WriteFile(dir+"/orphan-body", []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDisk(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.bytes != 0 {
+		t.Errorf("got %d tracked bytes, want 0 for a dir containing only an orphan", d.bytes)
+	}
+	if _, err := os.Stat(dir + "/orphan-body"); !os.IsNotExist(err) {
+		t.Error("expected the orphaned body file to be removed on reconcile")
+	}
+}
@@ -0,0 +1,84 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is an in-memory Cache that evicts the least-recently-used entries
+// once the total size of cached bodies exceeds maxBytes.
+type LRU struct {
+	maxBytes int64
+
+	mu         sync.Mutex
+	ll         *list.List
+	items      map[string]*list.Element
+	totalBytes int64
+}
+
+type lruItem struct {
+	key   string
+	entry Entry
+}
+
+// NewLRU returns an LRU which will keep at most maxBytes worth of entry
+// bodies in memory. A maxBytes of 0 means unbounded.
+func NewLRU(maxBytes int64) *LRU {
+	return &LRU{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get implements Cache.
+func (c *LRU) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+// Set implements Cache.
+func (c *LRU) Set(key string, e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.totalBytes -= int64(len(el.Value.(*lruItem).entry.Body))
+		el.Value.(*lruItem).entry = e
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&lruItem{key: key, entry: e})
+		c.items[key] = el
+	}
+	c.totalBytes += int64(len(e.Body))
+
+	c.evict()
+}
+
+// evict must be called with c.mu held.
+func (c *LRU) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	for c.totalBytes > c.maxBytes {
+		el := c.ll.Back()
+		if el == nil {
+			return
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *LRU) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	item := el.Value.(*lruItem)
+	delete(c.items, item.key)
+	c.totalBytes -= int64(len(item.entry.Body))
+}
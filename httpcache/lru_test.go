@@ -0,0 +1,54 @@
+package httpcache
+
+import "testing"
+
+func TestLRUGetSet(t *testing.T) {
+	c := NewLRU(0)
+	c.Set("a", Entry{Body: []byte("1")})
+
+	e, ok := c.Get("a")
+	if !ok {
+		t.Fatal("expected a hit for a freshly set key")
+	}
+	if string(e.Body) != "1" {
+		t.Errorf("got body %q, want %q", e.Body, "1")
+	}
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected a miss for a key that was never set")
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	// room for exactly two 1-byte bodies
+	c := NewLRU(2)
+	c.Set("a", Entry{Body: []byte("1")})
+	c.Set("b", Entry{Body: []byte("1")})
+
+	// touch "a" so "b" becomes the least recently used
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a hit for a")
+	}
+
+	c.Set("c", Entry{Body: []byte("1")})
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected b to have been evicted as the least recently used")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected a to survive eviction since it was touched last")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("expected c to be present since it was just set")
+	}
+}
+
+func TestLRUUnboundedWhenMaxBytesZero(t *testing.T) {
+	c := NewLRU(0)
+	for i := 0; i < 100; i++ {
+		c.Set(string(rune('a'+i%26))+string(rune(i)), Entry{Body: make([]byte, 1024)})
+	}
+	if c.totalBytes != 100*1024 {
+		t.Errorf("got totalBytes %d, want %d", c.totalBytes, 100*1024)
+	}
+}
@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"sync"
+	"time"
+)
+
+// Fetcher retrieves a fresh Entry for a cache key, e.g. by hitting the
+// TeamCity REST API.
+type Fetcher func() (Entry, error)
+
+// Revalidator wraps a Cache with stale-while-revalidate semantics: an
+// entry younger than ttl is returned as-is, an entry older than ttl but
+// younger than ttl+staleTTL is returned immediately while a background
+// goroutine refreshes it, and anything older is fetched synchronously.
+type Revalidator struct {
+	Cache    Cache
+	TTL      time.Duration
+	StaleTTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+// NewRevalidator returns a Revalidator backed by c.
+func NewRevalidator(c Cache, ttl, staleTTL time.Duration) *Revalidator {
+	return &Revalidator{
+		Cache:    c,
+		TTL:      ttl,
+		StaleTTL: staleTTL,
+		inflight: map[string]bool{},
+	}
+}
+
+// Get returns a value for key, calling fetch as needed per the rules
+// described on Revalidator. hit reports whether e was served straight
+// out of the cache, without this call blocking on fetch; it's false for
+// a cold lookup or an expired entry, even though a stale entry being
+// revalidated in the background still counts as a hit.
+func (r *Revalidator) Get(key string, fetch Fetcher) (e Entry, hit bool, err error) {
+	now := time.Now()
+	e, ok := r.Cache.Get(key)
+	if !ok {
+		e, err = r.fetchAndStore(key, fetch)
+		return e, false, err
+	}
+	if e.Fresh(r.TTL, now) {
+		return e, true, nil
+	}
+	if e.Fresh(r.TTL+r.StaleTTL, now) {
+		r.revalidateAsync(key, fetch)
+		return e, true, nil
+	}
+	e, err = r.fetchAndStore(key, fetch)
+	return e, false, err
+}
+
+func (r *Revalidator) fetchAndStore(key string, fetch Fetcher) (Entry, error) {
+	e, err := fetch()
+	if err != nil {
+		return Entry{}, err
+	}
+	e.StoredAt = time.Now()
+	r.Cache.Set(key, e)
+	return e, nil
+}
+
+// revalidateAsync kicks off a background refresh of key, unless one is
+// already running.
+func (r *Revalidator) revalidateAsync(key string, fetch Fetcher) {
+	r.mu.Lock()
+	if r.inflight[key] {
+		r.mu.Unlock()
+		return
+	}
+	r.inflight[key] = true
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.inflight, key)
+			r.mu.Unlock()
+		}()
+		r.fetchAndStore(key, fetch)
+	}()
+}
@@ -0,0 +1,191 @@
+package lfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SizeLookup returns the current Content-Length TeamCity reports for the
+// given artifact, used to validate what a client claims its object's
+// size is before advertising a download action for it.
+type SizeLookup func(buildTypeID, tag, artifactName string) (int64, error)
+
+// URLSigner returns the query string (e.g. "exp=123&sig=abc") that makes
+// path a validly signed url, for backends mounted with a urlsign.Signer.
+type URLSigner func(path string) string
+
+// Handler implements the Git LFS Batch API for objects resolved through
+// a Store. Only the "download" operation is supported; this service has
+// no way to accept uploads into TeamCity.
+type Handler struct {
+	Store      *Store
+	BaseURL    string // e.g. "http://localhost:8112", no trailing slash
+	SizeLookup SizeLookup
+
+	// AuthHeader, if set, is sent as the Authorization header value in
+	// every advertised download action, for clients to present back to
+	// this service's own routes.
+	AuthHeader string
+
+	// URLSigner, if set, is used to sign every advertised download href,
+	// for mounts that require a signed url.
+	URLSigner URLSigner
+}
+
+type batchRequest struct {
+	Operation string           `json:"operation"`
+	Transfers []string         `json:"transfers,omitempty"`
+	Objects   []batchObjectReq `json:"objects"`
+}
+
+type batchObjectReq struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type batchResponse struct {
+	Transfer string            `json:"transfer"`
+	Objects  []batchObjectResp `json:"objects"`
+}
+
+type batchObjectResp struct {
+	Oid     string            `json:"oid"`
+	Size    int64             `json:"size"`
+	Actions *batchActions     `json:"actions,omitempty"`
+	Error   *batchObjectError `json:"error,omitempty"`
+}
+
+type batchActions struct {
+	Download *batchAction `json:"download"`
+}
+
+type batchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type batchObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const lfsContentType = "application/vnd.git-lfs+json"
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid batch request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", lfsContentType)
+
+	if req.Operation != "download" {
+		resp := batchResponse{Transfer: "basic"}
+		for _, o := range req.Objects {
+			resp.Objects = append(resp.Objects, batchObjectResp{
+				Oid:  o.Oid,
+				Size: o.Size,
+				Error: &batchObjectError{
+					Code:    422,
+					Message: "only the download operation is supported",
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	resp := batchResponse{Transfer: "basic"}
+	for _, o := range req.Objects {
+		resp.Objects = append(resp.Objects, h.resolve(o))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) resolve(o batchObjectReq) batchObjectResp {
+	ref, ok := h.Store.Lookup(o.Oid)
+	if !ok {
+		return batchObjectResp{
+			Oid:  o.Oid,
+			Size: o.Size,
+			Error: &batchObjectError{
+				Code:    404,
+				Message: "no object with this oid is known",
+			},
+		}
+	}
+
+	size, err := h.SizeLookup(ref.BuildTypeID, ref.Tag, ref.ArtifactName)
+	if err != nil {
+		return batchObjectResp{
+			Oid:  o.Oid,
+			Size: o.Size,
+			Error: &batchObjectError{
+				Code:    500,
+				Message: "couldn't determine artifact size: " + err.Error(),
+			},
+		}
+	}
+	if size != o.Size {
+		return batchObjectResp{
+			Oid:  o.Oid,
+			Size: o.Size,
+			Error: &batchObjectError{
+				Code:    422,
+				Message: "object size does not match the artifact's current size",
+			},
+		}
+	}
+
+	parts := []string{h.BaseURL, escapePathSegments(ref.BuildTypeID)}
+	if ref.Tag != "" {
+		parts = append(parts, escapePathSegments(ref.Tag))
+	}
+	parts = append(parts, escapePathSegments(ref.ArtifactName))
+
+	href := strings.Join(parts, "/")
+	if h.URLSigner != nil {
+		// sign the unescaped path, since that's what a request for href
+		// carries as its decoded URL.Path when the signature is verified
+		rawPath := "/" + ref.BuildTypeID
+		if ref.Tag != "" {
+			rawPath += "/" + ref.Tag
+		}
+		rawPath += "/" + ref.ArtifactName
+		if qs := h.URLSigner(rawPath); qs != "" {
+			href += "?" + qs
+		}
+	}
+
+	action := &batchAction{Href: href}
+	if h.AuthHeader != "" {
+		action.Header = map[string]string{"Authorization": h.AuthHeader}
+	}
+
+	return batchObjectResp{
+		Oid:     o.Oid,
+		Size:    o.Size,
+		Actions: &batchActions{Download: action},
+	}
+}
+
+// escapePathSegments percent-escapes each "/"-delimited segment of s, so
+// a buildTypeID, tag, or artifactName containing a space, "#", "%", or
+// "?" produces a valid href, without escaping the "/" itself: some
+// backends' artifactName convention (e.g. gitlab's "job/path/to/file")
+// relies on "/" staying a path separator.
+func escapePathSegments(s string) string {
+	segs := strings.Split(s, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,50 @@
+// Package lfs implements enough of the Git LFS Batch API
+// (https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md) to let
+// Git LFS clients resolve objects to artifacts produced by TeamCity
+// builds and download them through this service's existing
+// /buildTypeID/[tag]/artifactName route.
+package lfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ObjectRef is what an LFS oid maps to: a specific TeamCity build type,
+// optional tag, and artifact name, resolved the same way the main HTTP
+// route resolves them.
+type ObjectRef struct {
+	BuildTypeID  string `json:"buildTypeID" yaml:"buildTypeID"`
+	Tag          string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	ArtifactName string `json:"artifactName" yaml:"artifactName"`
+}
+
+// Manifest maps an LFS oid to the artifact it corresponds to.
+type Manifest map[string]ObjectRef
+
+// LoadManifest reads a Manifest from path, which may be JSON or YAML; the
+// format is chosen based on the file's extension (.yml/.yaml for YAML,
+// anything else is treated as JSON).
+func LoadManifest(path string) (Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Manifest{}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yml" || ext == ".yaml" {
+		err = yaml.Unmarshal(b, &m)
+	} else {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing lfs manifest %s: %w", path, err)
+	}
+	return m, nil
+}
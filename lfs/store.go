@@ -0,0 +1,43 @@
+package lfs
+
+import "sync"
+
+// Store holds the currently-loaded Manifest and knows how to reload it
+// from disk, so that it can be kept live across a SIGHUP without
+// restarting the process.
+type Store struct {
+	path string
+
+	mu       sync.RWMutex
+	manifest Manifest
+}
+
+// NewStore loads the manifest at path and returns a Store wrapping it.
+func NewStore(path string) (*Store, error) {
+	m, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, manifest: m}, nil
+}
+
+// Reload re-reads the manifest from disk, replacing the in-memory copy
+// only if it parses successfully.
+func (s *Store) Reload() error {
+	m, err := LoadManifest(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.manifest = m
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the ObjectRef for an LFS oid, if the manifest has one.
+func (s *Store) Lookup(oid string) (ObjectRef, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ref, ok := s.manifest[oid]
+	return ref, ok
+}
@@ -1,26 +1,37 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/go-srvclient"
+	"github.com/levenlabs/teamcity-latest/backend/drone"
+	"github.com/levenlabs/teamcity-latest/backend/github"
+	"github.com/levenlabs/teamcity-latest/backend/gitlab"
+	"github.com/levenlabs/teamcity-latest/backend/teamcity"
+	"github.com/levenlabs/teamcity-latest/httpcache"
+	"github.com/levenlabs/teamcity-latest/lfs"
+	"github.com/levenlabs/teamcity-latest/urlsign"
 	"github.com/mediocregopher/lever"
 	"github.com/mediocregopher/skyapi/client"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// signedURLTTL is how long a url this service generates itself (i.e. a
+// Git LFS download href) remains valid for, when --url-signing-key is
+// set.
+const signedURLTTL = time.Hour
+
 var (
-	restUser, restPass, restAddr string
-	listenAddr                   string
-	skyapiAddr                   string
+	listenAddr string
+	skyapiAddr string
 )
 
 type requestParams struct {
@@ -29,6 +40,7 @@ type requestParams struct {
 	tag           string
 	artifactName  string
 	latestBuildID string
+	requestID     string
 }
 
 func (r requestParams) log(f llog.LogFunc, msg string, kvs ...llog.KV) {
@@ -47,6 +59,9 @@ func (r requestParams) log(f llog.LogFunc, msg string, kvs ...llog.KV) {
 	if r.latestBuildID != "" {
 		kv["latestBuildID"] = r.latestBuildID
 	}
+	if r.requestID != "" {
+		kv["requestID"] = r.requestID
+	}
 	f(msg, kv)
 }
 
@@ -79,17 +94,118 @@ func main() {
 		Description: "Minimum log level to show, either debug, info, warn, error, or fatal",
 		Default:     "info",
 	})
+	l.Add(lever.Param{
+		Name:        "--cache-dir",
+		Description: "Directory to persist cached artifacts to on disk. Unset means only cache in-memory",
+	})
+	l.Add(lever.Param{
+		Name:        "--cache-max-bytes",
+		Description: "Maximum total size, in bytes, of cached artifact bodies to keep. 0 means unbounded",
+		Default:     "1073741824",
+	})
+	l.Add(lever.Param{
+		Name:        "--cache-stale-ttl",
+		Description: "How long a cache entry may be served stale, while being refreshed in the background, after it expires",
+		Default:     "30s",
+	})
+	l.Add(lever.Param{
+		Name:        "--lfs-manifest",
+		Description: "Path to a JSON or YAML file mapping Git LFS oids to buildTypeID/tag/artifactName tuples. Unset means don't serve the /lfs/objects/batch route",
+	})
+	l.Add(lever.Param{
+		Name:        "--lfs-base-url",
+		Description: "Base URL this service is reachable at, used to build the href in Git LFS batch responses. Defaults to http://<listen-addr>",
+	})
+	l.Add(lever.Param{
+		Name:        "--gitlab-addr",
+		Description: "Address of a GitLab instance to also serve artifacts from, mounted at /gl/. Unset means don't mount it",
+	})
+	l.Add(lever.Param{
+		Name:        "--gitlab-token",
+		Description: "Personal or project access token to authenticate to GitLab with",
+	})
+	l.Add(lever.Param{
+		Name:        "--drone-addr",
+		Description: "Address of a Drone/Woodpecker server to also serve artifacts from, mounted at /drone/. Unset means don't mount it",
+	})
+	l.Add(lever.Param{
+		Name:        "--drone-token",
+		Description: "Personal access token to authenticate to Drone/Woodpecker with",
+	})
+	l.Add(lever.Param{
+		Name:        "--github-addr",
+		Description: "Address of the GitHub api to also serve Actions artifacts from, mounted at /gha/",
+		Default:     "https://api.github.com",
+	})
+	l.Add(lever.Param{
+		Name:        "--github-token",
+		Description: "Personal access token to authenticate to GitHub with. Unset means don't mount /gha/",
+	})
+	l.Add(lever.Param{
+		Name:        "--trace-header",
+		Description: "Name of a header to propagate (or generate, if absent) as a per-request trace id, included in llog lines and a Server-Timing response header. Unset means don't trace requests",
+	})
+	l.Add(lever.Param{
+		Name:        "--url-signing-key",
+		Description: "If set, every artifact request must carry a valid HMAC-signed, expiring 'exp' and 'sig' query string signed with this key, so the service can be exposed without leaking backend credentials. Unset means don't require one",
+	})
 	l.Parse()
 
-	restUser, _ = l.ParamStr("--rest-user")
-	restPass, _ = l.ParamStr("--rest-pass")
-	restAddr, _ = l.ParamStr("--rest-addr")
+	restUser, _ := l.ParamStr("--rest-user")
+	restPass, _ := l.ParamStr("--rest-pass")
+	restAddr, _ := l.ParamStr("--rest-addr")
 	listenAddr, _ = l.ParamStr("--listen-addr")
 	skyapiAddr, _ = l.ParamStr("--skyapi-addr")
 
 	logLevel, _ := l.ParamStr("--log-level")
 	llog.SetLevelFromString(logLevel)
 
+	cacheDir, _ := l.ParamStr("--cache-dir")
+	cacheMaxBytes, _ := l.ParamInt("--cache-max-bytes")
+	cacheStaleTTLStr, _ := l.ParamStr("--cache-stale-ttl")
+	cacheStaleTTL, err := time.ParseDuration(cacheStaleTTLStr)
+	if err != nil {
+		llog.Fatal("invalid --cache-stale-ttl", llog.KV{"err": err})
+	}
+
+	var cache httpcache.Cache
+	if cacheDir != "" {
+		cache, err = httpcache.NewDisk(cacheDir, int64(cacheMaxBytes))
+		if err != nil {
+			llog.Fatal("couldn't set up disk cache", llog.KV{"cacheDir": cacheDir, "err": err})
+		}
+	} else {
+		cache = httpcache.NewLRU(int64(cacheMaxBytes))
+	}
+
+	traceHeader, _ := l.ParamStr("--trace-header")
+
+	var signer *urlsign.Signer
+	if urlSigningKey, _ := l.ParamStr("--url-signing-key"); urlSigningKey != "" {
+		signer = urlsign.New(urlSigningKey)
+	}
+
+	// the TeamCity backend is mounted at both "/", for backwards
+	// compatibility, and "/tc/", for parity with the other backends.
+	tcMount := newMount("", teamcity.New(restAddr, restUser, restPass), cache, cacheStaleTTL, signer)
+	http.Handle("/", withTracing(traceHeader, tcMount))
+	http.Handle("/tc/", withTracing(traceHeader, newMount("/tc", teamcity.New(restAddr, restUser, restPass), cache, cacheStaleTTL, signer)))
+
+	if gitlabAddr, _ := l.ParamStr("--gitlab-addr"); gitlabAddr != "" {
+		gitlabToken, _ := l.ParamStr("--gitlab-token")
+		http.Handle("/gl/", withTracing(traceHeader, newMount("/gl", gitlab.New(gitlabAddr, gitlabToken), cache, cacheStaleTTL, signer)))
+	}
+	if droneAddr, _ := l.ParamStr("--drone-addr"); droneAddr != "" {
+		droneToken, _ := l.ParamStr("--drone-token")
+		http.Handle("/drone/", withTracing(traceHeader, newMount("/drone", drone.New(droneAddr, droneToken), cache, cacheStaleTTL, signer)))
+	}
+	if githubToken, _ := l.ParamStr("--github-token"); githubToken != "" {
+		githubAddr, _ := l.ParamStr("--github-addr")
+		http.Handle("/gha/", withTracing(traceHeader, newMount("/gha", github.New(githubAddr, githubToken), cache, cacheStaleTTL, signer)))
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+
 	if skyapiAddr != "" {
 		actualSkyapiAddr, err := srvclient.SRV(skyapiAddr)
 		if err != nil {
@@ -105,185 +221,148 @@ func main() {
 		}()
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var req requestParams
-		req.ip = r.RemoteAddr
-
-		parts := strings.Split(r.URL.Path[1:], "/")
-		if len(parts) < 2 {
-			req.log(llog.Warn, "invalid url, not enough parts", llog.KV{"url": r.URL.Path})
-			http.Error(w, "invalid url, must be /buildTypeID/[tag]/artifactName", 400)
-			return
-		}
-		req.buildTypeID = parts[0]
-		if len(parts) == 3 {
-			req.tag = parts[1]
-			req.artifactName = parts[2]
-		} else {
-			req.artifactName = parts[1]
+	lfsManifest, _ := l.ParamStr("--lfs-manifest")
+	if lfsManifest != "" {
+		lfsBaseURL, _ := l.ParamStr("--lfs-base-url")
+		if lfsBaseURL == "" {
+			lfsBaseURL = "http://" + listenAddr
 		}
 
-		if req.buildTypeID == "" || req.artifactName == "" {
-			req.log(llog.Warn, "invalid url, empty parts", llog.KV{"url": r.URL.Path})
-			http.Error(w, "invalid url, must be /buildTypeID/[tag]/artifactName", 400)
-			return
-		}
-
-		// if they sent a query include that as well
-		if r.URL.RawQuery != "" {
-			req.artifactName += "?" + r.URL.RawQuery
-		}
-
-		req.log(llog.Info, "request")
-
-		var err error
-		req.latestBuildID, err = latestBuildID(req.buildTypeID, req.tag)
+		store, err := lfs.NewStore(lfsManifest)
 		if err != nil {
-			req.log(llog.Error, "couldn't get last build id", llog.KV{"err": err})
-			http.Error(w, err.Error(), 500)
-			return
+			llog.Fatal("couldn't load lfs manifest", llog.KV{"lfsManifest": lfsManifest, "err": err})
 		}
 
-		if remoteHash := r.Header.Get("If-None-Match"); remoteHash != "" {
-			tcHash, err := artifactHash(req.latestBuildID, req.artifactName)
-			if err != nil {
-				req.log(llog.Error, "couldn't check hash", llog.KV{"err": err})
-				http.Error(w, fmt.Sprintf("Could not check hash: %s", err), 500)
-				return
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		go func() {
+			for range sigCh {
+				if err := store.Reload(); err != nil {
+					llog.Error("couldn't reload lfs manifest", llog.KV{"lfsManifest": lfsManifest, "err": err})
+				} else {
+					llog.Info("reloaded lfs manifest", llog.KV{"lfsManifest": lfsManifest})
+				}
 			}
-			if tcHash == remoteHash {
-				req.log(llog.Info, "hashes match, not retrieving")
-				w.WriteHeader(304)
-				return
+		}()
+
+		lfsHandler := &lfs.Handler{
+			Store:      store,
+			BaseURL:    strings.TrimRight(lfsBaseURL, "/"),
+			SizeLookup: tcMount.artifactSize,
+		}
+		var batchHandler http.Handler = lfsHandler
+		if signer != nil {
+			lfsHandler.URLSigner = func(path string) string {
+				return signer.Sign(path, time.Now().Add(signedURLTTL)).Encode()
 			}
+			batchHandler = requireSignedURL(signer, lfsHandler)
 		}
+		http.Handle("/lfs/objects/batch", batchHandler)
+	}
 
-		rc, contentLen, err := buildDownload(req.latestBuildID, req.artifactName)
-		if err != nil {
-			req.log(llog.Info, "couldn't get build download", llog.KV{"err": err})
-			http.Error(w, err.Error(), 500)
+	llog.Info("listening", llog.KV{"addr": listenAddr})
+	err = http.ListenAndServe(listenAddr, nil)
+	llog.Fatal("error listening", llog.KV{"err": err})
+}
+
+// requireSignedURL wraps next so a request must itself carry a valid
+// signature from signer before reaching it, the same check mount.go's
+// ServeHTTP applies to artifact downloads. It's used to keep the LFS
+// batch endpoint from being queried anonymously when --url-signing-key
+// is set: its response enumerates every oid's buildTypeID/tag/
+// artifactName and size from the manifest, which --url-signing-key is
+// meant to keep from untrusted callers just as much as the downloads
+// it links to.
+func requireSignedURL(signer *urlsign.Signer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := signer.Verify(r.URL.Path, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), 403)
 			return
 		}
-		defer rc.Close()
-
-		w.Header().Set("Content-Length", strconv.FormatInt(contentLen, 10))
-		io.Copy(w, rc)
+		next.ServeHTTP(w, r)
 	})
-
-	llog.Info("listening", llog.KV{"addr": listenAddr})
-	err := http.ListenAndServe(listenAddr, nil)
-	llog.Fatal("error listening", llog.KV{"err": err})
 }
 
-func latestBuildID(buildTypeID, tag string) (string, error) {
-	//status:SUCCESS means it succeeded
-	//branch:default:any means it can come from any branch
-	//count:1 means return the latest match only
-	l := []string{"status:SUCCESS", "branch:default:any", "count:1"}
-	//buildType:id:{id} will only return builds for the buildTypeID
-	l = append(l, fmt.Sprintf("buildType:id:%s", buildTypeID))
-	//if a tag was sent then filter to builds including this tag(s)
-	if tag != "" {
-		l = append(l, fmt.Sprintf("tag:%s", tag))
+// serveArtifactBody writes body to w, honoring a single-range Range
+// request from r, and returns the number of body bytes written. It's
+// used once an artifact's full body is already in hand, whether from the
+// cache or just buffered after the backend ignored a forwarded Range
+// header (see mount.go's serveRanged, which streams a backend's 206
+// straight through instead of ever reaching here).
+func serveArtifactBody(w http.ResponseWriter, r *http.Request, body []byte) int64 {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(body)), 10))
+		w.Write(body)
+		return int64(len(body))
 	}
-	u := fmt.Sprintf(
-		"%s/httpAuth/app/rest/builds/?locator=%s",
-		restAddr,
-		strings.Join(l, ","),
-	)
 
-	r, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return "", err
+	start, end, parsed := parseByteRange(rangeHeader, int64(len(body)))
+	if !parsed {
+		// malformed or multi-range Range header; ignore it and return the
+		// whole body, as RFC 7233 allows.
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(body)), 10))
+		w.Write(body)
+		return int64(len(body))
 	}
-	r.SetBasicAuth(restUser, restPass)
-	r.Header.Set("Accept", "application/json")
-
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return "", err
+	if start < 0 || start >= int64(len(body)) || end < start {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(body)))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return 0
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	resp.Body.Close()
-
-	out := struct {
-		Builds []struct {
-			ID int `json:"id"`
-		} `json:"build"`
-	}{}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(body[start : end+1])
+	return end - start + 1
+}
 
-	if err := json.Unmarshal(body, &out); err != nil {
-		return "", errors.New(string(body))
+// parseByteRange parses a "Range: bytes=..." header value into an
+// inclusive [start, end] byte range against a resource of the given
+// size. It only understands a single range; ok is false for anything
+// else, which callers should treat as if no Range header were sent.
+func parseByteRange(header string, size int64) (start, end int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, false
 	}
-
-	if len(out.Builds) < 1 {
-		return "", fmt.Errorf("no builds with tag '%s' found", tag)
+	spec := strings.TrimPrefix(header, prefix)
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
 	}
 
-	return strconv.Itoa(out.Builds[0].ID), nil
-}
-
-func artifactHash(id, artifactName string) (string, error) {
-	u := fmt.Sprintf(
-		"%s/httpAuth/app/rest/builds/id:%s/artifacts/content/%s.md5",
-		restAddr,
-		id,
-		artifactName,
-	)
-
-	r, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return "", err
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
 	}
-	r.SetBasicAuth(restUser, restPass)
 
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return "", err
+	if parts[0] == "" {
+		// suffix range: the last N bytes
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
 	}
-	defer resp.Body.Close()
 
-	berr, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
 	}
-
-	return strings.TrimSpace(string(berr)), nil
-}
-
-// the ReadCloser *must* be closed when done
-func buildDownload(id, artifactName string) (io.ReadCloser, int64, error) {
-	u := fmt.Sprintf(
-		"%s/httpAuth/app/rest/builds/id:%s/artifacts/content/%s",
-		restAddr,
-		id,
-		artifactName,
-	)
-
-	r, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, 0, err
+	if parts[1] == "" {
+		return start, size - 1, true
 	}
-	r.SetBasicAuth(restUser, restPass)
 
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return nil, 0, err
+	end, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
 	}
-
-	if resp.ContentLength < 0 {
-		berr, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, 0, err
-		}
-		resp.Body.Close()
-		return nil, 0, errors.New(string(berr))
+	if end >= size {
+		end = size - 1
 	}
-
-	return resp.Body, resp.ContentLength, nil
+	return start, end, true
 }
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	const size = int64(100)
+
+	cases := []struct {
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantOK    bool
+	}{
+		{"bytes=0-49", 0, 49, true},
+		{"bytes=50-", 50, 99, true},
+		{"bytes=-10", 90, 99, true},
+		{"bytes=-1000", 0, 99, true},      // suffix longer than size clamps to the whole body
+		{"bytes=0-1000", 0, 99, true},     // end past size clamps to the last byte
+		{"bytes=10-5", 0, 0, false},       // end before start
+		{"bytes=0-10,20-30", 0, 0, false}, // multi-range unsupported
+		{"bytes=abc-10", 0, 0, false},
+		{"", 0, 0, false},
+		{"not-bytes=0-10", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		start, end, ok := parseByteRange(c.header, size)
+		if ok != c.wantOK {
+			t.Errorf("parseByteRange(%q, %d): ok = %v, want %v", c.header, size, ok, c.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if start != c.wantStart || end != c.wantEnd {
+			t.Errorf("parseByteRange(%q, %d) = (%d, %d), want (%d, %d)", c.header, size, start, end, c.wantStart, c.wantEnd)
+		}
+	}
+}
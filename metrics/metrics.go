@@ -0,0 +1,67 @@
+// Package metrics holds the Prometheus collectors teamcity-latest exposes
+// at /metrics. It's a package of its own, rather than living in main,
+// so that every mount and backend can record to the same collectors
+// without an import cycle back into main.
+//
+// Labeling by buildTypeID/tag means label cardinality is bounded by how
+// many distinct buildTypeID/tag pairs are actually requested, not
+// fixed ahead of time; that's acceptable here since teamcity-latest sits
+// behind a known set of CI jobs rather than open to arbitrary clients,
+// but would need revisiting (e.g. dropping tag, or only labeling known
+// buildTypeIDs) if it were ever exposed more broadly.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// RequestsTotal counts artifact requests handled by a mount.
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teamcity_latest_requests_total",
+		Help: "Total number of artifact requests handled.",
+	}, []string{"buildTypeID", "tag"})
+
+	// RequestsInFlight tracks artifact requests currently being handled.
+	RequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "teamcity_latest_requests_in_flight",
+		Help: "Number of artifact requests currently being handled.",
+	}, []string{"buildTypeID", "tag"})
+
+	// UpstreamLatencySeconds measures how long backend calls take, split
+	// by which backend.Backend method was called.
+	UpstreamLatencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "teamcity_latest_upstream_latency_seconds",
+		Help:    "Latency of calls to a CI backend, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op", "buildTypeID", "tag"})
+
+	// CacheResultsTotal counts how often a buildID/artifact lookup was
+	// served from cache versus required a backend fetch.
+	CacheResultsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teamcity_latest_cache_results_total",
+		Help: "Cache hits and misses for buildID/artifact lookups.",
+	}, []string{"result", "buildTypeID", "tag"})
+
+	// NotModifiedTotal counts requests short-circuited with a 304, via
+	// If-None-Match matching the cached artifact's ETag.
+	NotModifiedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teamcity_latest_not_modified_total",
+		Help: "Requests short-circuited with a 304 Not Modified.",
+	}, []string{"buildTypeID", "tag"})
+
+	// BytesServedTotal counts bytes of artifact body written to clients.
+	BytesServedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teamcity_latest_bytes_served_total",
+		Help: "Total bytes of artifact body written to clients.",
+	}, []string{"buildTypeID", "tag"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RequestsTotal,
+		RequestsInFlight,
+		UpstreamLatencySeconds,
+		CacheResultsTotal,
+		NotModifiedTotal,
+		BytesServedTotal,
+	)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/teamcity-latest/backend"
+	"github.com/levenlabs/teamcity-latest/httpcache"
+	"github.com/levenlabs/teamcity-latest/metrics"
+	"github.com/levenlabs/teamcity-latest/urlsign"
+	"golang.org/x/sync/singleflight"
+)
+
+// buildIDFreshTTL is how long a latestBuildID lookup is considered fresh
+// before it needs revalidating. It's kept short since a new build
+// finishing should show up quickly.
+const buildIDFreshTTL = 5 * time.Second
+
+// artifactFreshTTL is how long a cached artifact body is considered
+// fresh. Artifacts are immutable for a given build id, so this is mostly
+// about giving the stale-while-revalidate path something to expire, not
+// about correctness.
+const artifactFreshTTL = time.Hour
+
+// mount binds a backend.Backend to a URL prefix, along with its own
+// build id/artifact caches. Every CI system teamcity-latest can talk to
+// is reachable this way, including the original TeamCity backend, which
+// is mounted at both "/" (for backwards compatibility) and "/tc/".
+//
+// Mounts are usually backed by one shared httpcache.Cache (see main's
+// --cache-dir/--cache-max-bytes), so every cache key built from a mount
+// goes through cacheKey to stay namespaced by prefix; without that, two
+// mounts using the same buildTypeID/buildID conventions, as Drone and
+// GitHub Actions both do with "owner/name", could read back each
+// other's cached build ids or artifact bytes.
+type mount struct {
+	prefix  string
+	backend backend.Backend
+	signer  *urlsign.Signer // nil means don't require a signed url
+
+	buildIDCache  *httpcache.Revalidator
+	artifactCache *httpcache.Revalidator
+
+	// buildIDGroup, hashGroup, and artifactGroup coalesce concurrent
+	// cold-cache lookups for the same key into a single backend call, so
+	// that e.g. a CI system kicking off many parallel deploys that all
+	// race to fetch the same just-finished build's artifact only hits
+	// the backend once for each of a build id, a hash, and a download.
+	buildIDGroup  singleflight.Group
+	hashGroup     singleflight.Group
+	artifactGroup singleflight.Group
+}
+
+// newMount wraps b in a mount rooted at prefix, with its own caches
+// backed by cache. signer may be nil, meaning requests to this mount
+// don't need to carry a signed url.
+func newMount(prefix string, b backend.Backend, cache httpcache.Cache, staleTTL time.Duration, signer *urlsign.Signer) *mount {
+	return &mount{
+		prefix:        prefix,
+		backend:       b,
+		signer:        signer,
+		buildIDCache:  httpcache.NewRevalidator(cache, buildIDFreshTTL, staleTTL),
+		artifactCache: httpcache.NewRevalidator(cache, artifactFreshTTL, staleTTL),
+	}
+}
+
+// cachedLatestBuildID is backend.LatestBuildID fronted by m's
+// buildIDCache, so that a burst of requests for the same
+// buildTypeID/tag doesn't hit the backend's api once per request.
+func (m *mount) cachedLatestBuildID(buildTypeID, tag string) (string, error) {
+	key := m.cacheKey(buildTypeID, tag)
+	v, err, _ := m.buildIDGroup.Do(key, func() (interface{}, error) {
+		e, hit, err := m.buildIDCache.Get(key, func() (httpcache.Entry, error) {
+			start := time.Now()
+			id, err := m.backend.LatestBuildID(buildTypeID, tag)
+			metrics.UpstreamLatencySeconds.WithLabelValues("latestBuildID", buildTypeID, tag).Observe(time.Since(start).Seconds())
+			if err != nil {
+				return httpcache.Entry{}, err
+			}
+			return httpcache.Entry{Body: []byte(id)}, nil
+		})
+		metrics.CacheResultsTotal.WithLabelValues(cacheResultLabel(hit), buildTypeID, tag).Inc()
+		return e, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(v.(httpcache.Entry).Body), nil
+}
+
+// artifactHash is backend.ArtifactHash, coalesced by hashGroup so a burst
+// of concurrent requests for the same buildID/artifactName (including
+// ones that end up being cache hits) shares one upstream lookup rather
+// than each making their own. It isn't cached itself, since it's cheap
+// (no body transfer) and its result is only used as the artifact's ETag,
+// to key the artifact cache, and to dedup within a single request's
+// lifetime.
+func (m *mount) artifactHash(buildTypeID, tag, buildID, artifactName string) (string, error) {
+	groupKey := buildID + "|" + artifactName
+	v, err, _ := m.hashGroup.Do(groupKey, func() (interface{}, error) {
+		start := time.Now()
+		hash, err := m.backend.ArtifactHash(buildID, artifactName)
+		metrics.UpstreamLatencySeconds.WithLabelValues("artifactHash", buildTypeID, tag).Observe(time.Since(start).Seconds())
+		return hash, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// cachedArtifact is backend.Download fronted by m's artifactCache, keyed
+// on key (built from the artifact's own hash, when the backend has one,
+// so that an artifact only has to be pulled down once per build).
+//
+// It's only used for the common case: a cache miss with no Range header.
+// A cache miss that does carry a Range header is handled by serveRanged
+// instead, which bypasses both this cache and the singleflight group
+// below, since two requests wanting different byte ranges of the same
+// cold artifact must each get their own upstream fetch, not share one.
+//
+// The singleflight group is keyed on buildID/artifactName rather than
+// buildTypeID/tag/artifactName: two requests only share a download if
+// they already agree on which build they want, so a request that races
+// a buildID revalidation can never be handed another request's stale
+// build's bytes.
+func (m *mount) cachedArtifact(buildTypeID, tag, buildID, artifactName, hash, key string) (httpcache.Entry, error) {
+	groupKey := buildID + "|" + artifactName
+	v, err, _ := m.artifactGroup.Do(groupKey, func() (interface{}, error) {
+		e, hit, err := m.artifactCache.Get(key, func() (httpcache.Entry, error) {
+			start := time.Now()
+			res, err := m.backend.Download(buildID, artifactName, "")
+			metrics.UpstreamLatencySeconds.WithLabelValues("buildDownload", buildTypeID, tag).Observe(time.Since(start).Seconds())
+			if err != nil {
+				return httpcache.Entry{}, err
+			}
+			defer res.Body.Close()
+
+			body, err := teeToTempFile(res.Body)
+			if err != nil {
+				return httpcache.Entry{}, err
+			}
+			return httpcache.Entry{ETag: hash, Body: body}, nil
+		})
+		metrics.CacheResultsTotal.WithLabelValues(cacheResultLabel(hit), buildTypeID, tag).Inc()
+		return e, err
+	})
+	if err != nil {
+		return httpcache.Entry{}, err
+	}
+	return v.(httpcache.Entry), nil
+}
+
+// serveRanged serves a cache-miss request that carries a Range header by
+// forwarding rangeHeader straight to the backend, bypassing cachedArtifact
+// entirely. If the backend honors it (206), the response is streamed
+// straight through without ever being buffered or cached. If the backend
+// ignores it and returns the whole body (200), that body is buffered,
+// stored under key like a normal fetch would be, and served the same way
+// a cache hit is.
+func (m *mount) serveRanged(w http.ResponseWriter, r *http.Request, req requestParams, hash, key, rangeHeader string) {
+	start := time.Now()
+	res, err := m.backend.Download(req.latestBuildID, req.artifactName, rangeHeader)
+	metrics.UpstreamLatencySeconds.WithLabelValues("buildDownload", req.buildTypeID, req.tag).Observe(time.Since(start).Seconds())
+	if err != nil {
+		req.log(llog.Info, "couldn't get build download", llog.KV{"err": err})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusPartialContent {
+		if hash != "" {
+			w.Header().Set("ETag", hash)
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Range", res.ContentRange)
+		w.Header().Set("Content-Length", strconv.FormatInt(res.Size, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		n, _ := io.Copy(w, res.Body)
+		metrics.BytesServedTotal.WithLabelValues(req.buildTypeID, req.tag).Add(float64(n))
+		return
+	}
+
+	body, err := teeToTempFile(res.Body)
+	if err != nil {
+		req.log(llog.Error, "couldn't buffer build download", llog.KV{"err": err})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	entry := httpcache.Entry{ETag: hash, Body: body, StoredAt: time.Now()}
+	m.artifactCache.Cache.Set(key, entry)
+	m.serveEntry(w, r, req, entry)
+}
+
+// serveEntry writes a fully-buffered artifact entry to w, honoring
+// If-None-Match and a Range header, whether entry was just read out of
+// the cache or was buffered in full moments ago by serveRanged.
+func (m *mount) serveEntry(w http.ResponseWriter, r *http.Request, req requestParams, entry httpcache.Entry) {
+	if remoteHash := r.Header.Get("If-None-Match"); remoteHash != "" && remoteHash == entry.ETag {
+		req.log(llog.Info, "hashes match, not retrieving")
+		metrics.NotModifiedTotal.WithLabelValues(req.buildTypeID, req.tag).Inc()
+		w.WriteHeader(304)
+		return
+	}
+
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	n := serveArtifactBody(w, r, entry.Body)
+	metrics.BytesServedTotal.WithLabelValues(req.buildTypeID, req.tag).Add(float64(n))
+}
+
+// teeToTempFile copies rc to a temp file and reads it back, rather than
+// growing an in-memory buffer directly against rc. Combined with the
+// singleflight.Group in cachedArtifact, this means a burst of concurrent
+// requests for the same cold artifact results in exactly one download,
+// staged through one temp file, with every waiter receiving the same
+// resulting bytes rather than triggering a download of its own. It
+// stops short of letting waiters stream from the file while it's still
+// being written, which would need a dedicated multi-reader type this
+// codebase doesn't have yet.
+func teeToTempFile(rc io.Reader) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "teamcity-latest-artifact-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, rc); err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(tmp)
+}
+
+// cacheResultLabel maps a Revalidator.Get hit bool to the label value
+// used on CacheResultsTotal.
+func cacheResultLabel(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// cacheKey scopes parts to this mount's own namespace within the
+// (possibly shared) underlying httpcache.Cache, so that two mounts using
+// the same buildTypeID/buildID conventions, e.g. Drone and GitHub
+// Actions both using "owner/name", never read back each other's cached
+// build ids or artifact bytes.
+func (m *mount) cacheKey(parts ...string) string {
+	return strings.Join(append([]string{m.prefix}, parts...), "|")
+}
+
+// artifactSize resolves buildTypeID/tag to a build on m's backend and
+// returns the size of artifactName, without downloading its body. It's
+// used to validate the size an LFS client claims for an object before
+// advertising a download action for it.
+func (m *mount) artifactSize(buildTypeID, tag, artifactName string) (int64, error) {
+	id, err := m.cachedLatestBuildID(buildTypeID, tag)
+	if err != nil {
+		return 0, err
+	}
+	return m.backend.ArtifactSize(id, artifactName)
+}
+
+// ServeHTTP implements the /buildTypeID/[tag]/artifactName route against
+// m's backend.
+func (m *mount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req requestParams
+	req.ip = r.RemoteAddr
+
+	path := strings.TrimPrefix(r.URL.Path, m.prefix)
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	// buildTypeID itself can contain a literal "/", as it does for
+	// Drone and GitHub Actions' "owner/name" convention, so how many
+	// leading segments belong to it is up to the backend, not a
+	// hardcoded parts[0].
+	n := m.backend.BuildTypeIDSegments()
+	if len(parts) < n+1 {
+		req.log(llog.Warn, "invalid url, not enough parts", llog.KV{"url": r.URL.Path})
+		http.Error(w, "invalid url, must be /buildTypeID/[tag]/artifactName", 400)
+		return
+	}
+	req.buildTypeID = strings.Join(parts[:n], "/")
+	rest := parts[n:]
+	if len(rest) > 1 {
+		req.tag = rest[0]
+		req.artifactName = strings.Join(rest[1:], "/")
+	} else {
+		req.artifactName = rest[0]
+	}
+
+	if req.buildTypeID == "" || req.artifactName == "" {
+		req.log(llog.Warn, "invalid url, empty parts", llog.KV{"url": r.URL.Path})
+		http.Error(w, "invalid url, must be /buildTypeID/[tag]/artifactName", 400)
+		return
+	}
+
+	req.requestID = requestIDFromContext(r.Context())
+
+	// forwarded to the backend as part of artifactName, below; rebuilt
+	// only if a signer strips exp/sig from it, to avoid re-encoding (and
+	// so possibly changing) every other request's query string.
+	rawQuery := r.URL.RawQuery
+	if m.signer != nil {
+		query := r.URL.Query()
+		if err := m.signer.Verify(r.URL.Path, query); err != nil {
+			req.log(llog.Warn, "rejected unsigned or invalid url", llog.KV{"err": err})
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		query.Del("exp")
+		query.Del("sig")
+		rawQuery = query.Encode()
+	}
+
+	// if they sent any other query params, include those as well
+	if rawQuery != "" {
+		req.artifactName += "?" + rawQuery
+	}
+
+	metrics.RequestsTotal.WithLabelValues(req.buildTypeID, req.tag).Inc()
+	inFlight := metrics.RequestsInFlight.WithLabelValues(req.buildTypeID, req.tag)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	req.log(llog.Info, "request")
+
+	var err error
+	req.latestBuildID, err = m.cachedLatestBuildID(req.buildTypeID, req.tag)
+	if err != nil {
+		req.log(llog.Error, "couldn't get last build id", llog.KV{"err": err})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	hash, err := m.artifactHash(req.buildTypeID, req.tag, req.latestBuildID, req.artifactName)
+	if err != nil {
+		req.log(llog.Error, "couldn't get artifact hash", llog.KV{"err": err})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	key := m.cacheKey(req.latestBuildID, req.artifactName, hash)
+
+	// if the client already has this exact artifact, answer 304 without
+	// downloading it, whether or not it's cached
+	if remoteHash := r.Header.Get("If-None-Match"); remoteHash != "" && remoteHash == hash {
+		req.log(llog.Info, "hashes match, not retrieving")
+		metrics.NotModifiedTotal.WithLabelValues(req.buildTypeID, req.tag).Inc()
+		w.WriteHeader(304)
+		return
+	}
+
+	// a hit here is served straight from the cache, with no download from
+	// the backend;
+	// staleness doesn't matter for correctness since key already embeds
+	// the artifact's own content hash, so this bypasses the
+	// Revalidator's TTL dance on purpose.
+	if entry, ok := m.artifactCache.Cache.Get(key); ok {
+		metrics.CacheResultsTotal.WithLabelValues("hit", req.buildTypeID, req.tag).Inc()
+		m.serveEntry(w, r, req, entry)
+		return
+	}
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		metrics.CacheResultsTotal.WithLabelValues("miss", req.buildTypeID, req.tag).Inc()
+		m.serveRanged(w, r, req, hash, key, rangeHeader)
+		return
+	}
+
+	artifact, err := m.cachedArtifact(req.buildTypeID, req.tag, req.latestBuildID, req.artifactName, hash, key)
+	if err != nil {
+		req.log(llog.Info, "couldn't get build download", llog.KV{"err": err})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	m.serveEntry(w, r, req, artifact)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// ctxKey is an unexported type for context keys owned by this package, so
+// they can't collide with keys set elsewhere.
+type ctxKey int
+
+const requestIDCtxKey ctxKey = iota
+
+// withTracing wraps next so that every request carries a request id: one
+// read from the incoming headerName header if the client sent it, or a
+// freshly generated one otherwise. The id is echoed back in the same
+// response header, added to a Server-Timing header, and made available
+// to handlers via requestIDFromContext so it can be included in llog
+// lines. If headerName is empty, tracing is disabled and next is
+// returned unwrapped.
+func withTracing(headerName string, next http.Handler) http.Handler {
+	if headerName == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerName)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(headerName, id)
+		w.Header().Set("Server-Timing", fmt.Sprintf("req;desc=%q", id))
+
+		ctx := context.WithValue(r.Context(), requestIDCtxKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFromContext returns the request id withTracing stashed in
+// ctx, or "" if tracing is disabled or ctx didn't come from withTracing.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey).(string)
+	return id
+}
+
+// newRequestID returns a random id suitable for use as a request id.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
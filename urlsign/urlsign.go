@@ -0,0 +1,68 @@
+// Package urlsign signs and verifies expiring artifact URLs, so that
+// teamcity-latest can be exposed to clients that shouldn't be trusted
+// with TeamCity (or another backend's) own credentials.
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signer signs and verifies a URL path against a shared key, using an
+// "exp" query param (a Unix timestamp) and a "sig" query param (an
+// HMAC-SHA256 of the path and exp, hex-encoded).
+type Signer struct {
+	Key []byte
+}
+
+// New returns a Signer using key to compute and verify signatures.
+func New(key string) *Signer {
+	return &Signer{Key: []byte(key)}
+}
+
+// Sign returns the "exp" and "sig" query params that make path valid
+// until exp.
+func (s *Signer) Sign(path string, exp time.Time) url.Values {
+	expStr := strconv.FormatInt(exp.Unix(), 10)
+	v := url.Values{}
+	v.Set("exp", expStr)
+	v.Set("sig", s.sign(path, expStr))
+	return v
+}
+
+// Verify checks that query carries a valid, unexpired signature for
+// path, as produced by Sign.
+func (s *Signer) Verify(path string, query url.Values) error {
+	expStr := query.Get("exp")
+	sig := query.Get("sig")
+	if expStr == "" || sig == "" {
+		return errors.New("url is missing exp/sig query params")
+	}
+
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil {
+		return errors.New("url has a malformed exp query param")
+	}
+	if time.Now().Unix() > exp {
+		return errors.New("url has expired")
+	}
+
+	want := s.sign(path, expStr)
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return errors.New("url has an invalid signature")
+	}
+	return nil
+}
+
+func (s *Signer) sign(path, expStr string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(path))
+	mac.Write([]byte("?exp="))
+	mac.Write([]byte(expStr))
+	return hex.EncodeToString(mac.Sum(nil))
+}
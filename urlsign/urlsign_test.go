@@ -0,0 +1,51 @@
+package urlsign
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	s := New("shared-secret")
+	path := "/gha/owner/repo/artifact.zip"
+
+	query := s.Sign(path, time.Now().Add(time.Hour))
+	if err := s.Verify(path, query); err != nil {
+		t.Errorf("Verify failed on a just-signed url: %v", err)
+	}
+}
+
+func TestVerifyRejectsExpired(t *testing.T) {
+	s := New("shared-secret")
+	path := "/gha/owner/repo/artifact.zip"
+
+	query := s.Sign(path, time.Now().Add(-time.Minute))
+	if err := s.Verify(path, query); err == nil {
+		t.Error("expected Verify to reject an expired signature")
+	}
+}
+
+func TestVerifyRejectsTamperedPath(t *testing.T) {
+	s := New("shared-secret")
+	query := s.Sign("/gha/owner/repo/artifact.zip", time.Now().Add(time.Hour))
+
+	if err := s.Verify("/gha/owner/repo/other.zip", query); err == nil {
+		t.Error("expected Verify to reject a signature for a different path")
+	}
+}
+
+func TestVerifyRejectsWrongKey(t *testing.T) {
+	path := "/gha/owner/repo/artifact.zip"
+	query := New("key-one").Sign(path, time.Now().Add(time.Hour))
+
+	if err := New("key-two").Verify(path, query); err == nil {
+		t.Error("expected Verify to reject a signature made with a different key")
+	}
+}
+
+func TestVerifyRejectsMissingParams(t *testing.T) {
+	s := New("shared-secret")
+	if err := s.Verify("/gha/owner/repo/artifact.zip", nil); err == nil {
+		t.Error("expected Verify to reject a url with no exp/sig query params")
+	}
+}